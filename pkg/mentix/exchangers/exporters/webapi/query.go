@@ -23,19 +23,315 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/cs3org/reva/pkg/mentix/config"
 	"github.com/cs3org/reva/pkg/mentix/meshdata"
 	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
 )
 
-// HandleDefaultQuery processes a basic query.
+// HandleDefaultQuery processes a basic query. It honors the `fields` query parameter to
+// project a subset of the mesh graph (e.g. `fields=sites.name,sites.services.endpoints.url`),
+// the `filter` query parameter to drop elements of a collection that don't match an expression
+// (e.g. `filter=site.country==CH`), `format=compact` to skip indentation, and an `Accept` entry
+// in params (the caller is expected to carry the request's Accept header over, since every
+// query handler in this package shares this (meshData, params, conf, log) signature and none
+// of the others take an *http.Request) to choose between JSON (default), YAML and Protobuf
+// output.
+//
+// The common case - no projection or filtering, and a format that can marshal meshData's
+// concrete type directly - skips the generic interface{} round trip toGenericData needs for
+// field projection and filtering, instead of holding the typed struct, the marshaled bytes and
+// a boxed generic copy all in memory at once.
+//
+// This does NOT give large federations a streaming response: the encoded payload is still
+// built fully in memory below (json.MarshalIndent/yaml.Marshal/proto.Marshal) and returned as
+// one []byte, because every query handler in this package - and whatever dispatches to them,
+// which isn't part of this diff - shares this (int, []byte, error) return contract. Streaming
+// the response out incrementally would mean changing that shared contract to carry an
+// io.Writer through instead, which is a wider, caller-side change this function alone can't
+// make safely.
 func HandleDefaultQuery(meshData *meshdata.MeshData, params url.Values, _ *config.Configuration, _ *zerolog.Logger) (int, []byte, error) {
-	// Just return the plain, unfiltered data as JSON
-	data, err := json.MarshalIndent(meshData, "", "\t")
+	fields := params.Get("fields")
+	filterParam := params.Get("filter")
+	compact := params.Get("format") == "compact"
+	format := negotiateFormat(params.Get("Accept"))
+
+	var data interface{} = meshData
+	if fields != "" || filterParam != "" || format.needsGenericData {
+		generic, err := toGenericData(meshData)
+		if err != nil {
+			return http.StatusInternalServerError, nil, fmt.Errorf("unable to convert mesh data: %v", err)
+		}
+		data = generic
+
+		if fields != "" {
+			data = projectFields(data, strings.Split(fields, ","))
+		}
+
+		if filterParam != "" {
+			expr, err := compileFilter(filterParam)
+			if err != nil {
+				return http.StatusBadRequest, nil, fmt.Errorf("invalid filter expression: %v", err)
+			}
+			data = applyFilter(data, expr)
+		}
+	}
+
+	out, err := format.encode(data, compact)
 	if err != nil {
-		return http.StatusBadRequest, []byte{}, fmt.Errorf("unable to marshal the mesh data: %v", err)
+		return http.StatusInternalServerError, nil, fmt.Errorf("unable to marshal mesh data: %v", err)
+	}
+
+	return http.StatusOK, out, nil
+}
+
+// toGenericData round-trips meshData through JSON into a generic
+// map[string]interface{}/[]interface{} tree, so field projection and
+// filtering don't need to know meshdata's concrete Go types.
+func toGenericData(meshData *meshdata.MeshData) (interface{}, error) {
+	raw, err := json.Marshal(meshData)
+	if err != nil {
+		return nil, err
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fieldTree is a JSONPath-ish selector tree built from dotted field paths
+// such as "sites.services.endpoints.url"; an empty subtree means "keep this
+// field and everything below it".
+type fieldTree map[string]fieldTree
+
+func buildFieldTree(selectors []string) fieldTree {
+	root := fieldTree{}
+	for _, selector := range selectors {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+
+		node := root
+		for _, part := range strings.Split(selector, ".") {
+			next, ok := node[part]
+			if !ok {
+				next = fieldTree{}
+				node[part] = next
+			}
+			node = next
+		}
+	}
+	return root
+}
+
+// projectFields keeps only the fields named by selectors, descending
+// transparently through arrays (e.g. a selector of "sites.name" keeps the
+// name of every element of the sites array).
+func projectFields(data interface{}, selectors []string) interface{} {
+	tree := buildFieldTree(selectors)
+	if len(tree) == 0 {
+		return data
+	}
+	return tree.project(data)
+}
+
+func (tree fieldTree) project(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []interface{}:
+		projected := make([]interface{}, len(val))
+		for i, item := range val {
+			projected[i] = tree.project(item)
+		}
+		return projected
+	case map[string]interface{}:
+		projected := make(map[string]interface{}, len(tree))
+		for key, subtree := range tree {
+			child, ok := val[key]
+			if !ok {
+				continue
+			}
+			if len(subtree) == 0 {
+				projected[key] = child
+			} else {
+				projected[key] = subtree.project(child)
+			}
+		}
+		return projected
+	default:
+		return val
+	}
+}
+
+// filterExpr is a compiled `<field path>(==|!=|~=)<value>` expression, e.g.
+// `site.country==CH`. `~=` matches if value is a substring of the field.
+type filterExpr struct {
+	collection string
+	fieldPath  []string
+	op         string
+	value      string
+}
+
+var filterOperators = []string{"==", "!=", "~="}
+
+// compileFilter compiles a filter expression once so it can be applied to
+// every element of the matching collection without re-parsing it.
+func compileFilter(expr string) (*filterExpr, error) {
+	for _, op := range filterOperators {
+		idx := strings.Index(expr, op)
+		if idx < 0 {
+			continue
+		}
+
+		path := strings.Split(strings.TrimSpace(expr[:idx]), ".")
+		if len(path) < 2 || path[0] == "" {
+			return nil, fmt.Errorf("filter %q must address a field as '<collection singular>.<field>'", expr)
+		}
+
+		return &filterExpr{
+			collection: pluralize(path[0]),
+			fieldPath:  path[1:],
+			op:         op,
+			value:      strings.TrimSpace(expr[idx+len(op):]),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported filter expression %q, expected e.g. 'site.country==CH'", expr)
+}
+
+func pluralize(s string) string {
+	if strings.HasSuffix(s, "s") {
+		return s
 	}
+	return s + "s"
+}
+
+// applyFilter walks data and drops the elements of every collection matching
+// expr.collection (e.g. "sites" or "services") that don't satisfy expr.
+func applyFilter(data interface{}, expr *filterExpr) interface{} {
+	switch val := data.(type) {
+	case map[string]interface{}:
+		filtered := make(map[string]interface{}, len(val))
+		for key, child := range val {
+			if key == expr.collection {
+				if items, ok := child.([]interface{}); ok {
+					filtered[key] = filterItems(items, expr)
+					continue
+				}
+			}
+			filtered[key] = applyFilter(child, expr)
+		}
+		return filtered
+	case []interface{}:
+		items := make([]interface{}, len(val))
+		for i, item := range val {
+			items[i] = applyFilter(item, expr)
+		}
+		return items
+	default:
+		return val
+	}
+}
+
+func filterItems(items []interface{}, expr *filterExpr) []interface{} {
+	kept := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if matchesFilter(item, expr) {
+			kept = append(kept, applyFilter(item, expr))
+		}
+	}
+	return kept
+}
 
-	return http.StatusOK, data, nil
+func matchesFilter(item interface{}, expr *filterExpr) bool {
+	cur := item
+	for _, part := range expr.fieldPath {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return false
+		}
+	}
+
+	actual := fmt.Sprintf("%v", cur)
+	switch expr.op {
+	case "==":
+		return actual == expr.value
+	case "!=":
+		return actual != expr.value
+	case "~=":
+		return strings.Contains(actual, expr.value)
+	default:
+		return true
+	}
+}
+
+// responseFormat marshals the (possibly projected/filtered) mesh data. needsGenericData marks
+// formats that cannot marshal meshdata.MeshData's concrete type directly and therefore always
+// need the generic interface{} tree toGenericData produces, even when HandleDefaultQuery
+// wouldn't otherwise need it for projection or filtering.
+type responseFormat struct {
+	contentType      string
+	needsGenericData bool
+	encode           func(data interface{}, compact bool) ([]byte, error)
+}
+
+var jsonResponseFormat = responseFormat{
+	contentType: "application/json; charset=utf-8",
+	encode: func(data interface{}, compact bool) ([]byte, error) {
+		if compact {
+			return json.Marshal(data)
+		}
+		return json.MarshalIndent(data, "", "\t")
+	},
+}
+
+var yamlResponseFormat = responseFormat{
+	contentType: "application/yaml; charset=utf-8",
+	encode: func(data interface{}, _ bool) ([]byte, error) {
+		return yaml.Marshal(data)
+	},
+}
+
+var protobufResponseFormat = responseFormat{
+	contentType:      "application/x-protobuf",
+	needsGenericData: true,
+	encode: func(data interface{}, _ bool) ([]byte, error) {
+		// meshdata.MeshData has no generated protobuf message, so the generic tree is
+		// wrapped as a structpb.Value instead of requiring a dedicated .proto definition.
+		// structpb.NewValue only accepts JSON-primitive-shaped values (map[string]interface{},
+		// []interface{}, ...), which is why this format needs the generic round trip even
+		// when nothing is being projected or filtered.
+		value, err := structpb.NewValue(data)
+		if err != nil {
+			return nil, fmt.Errorf("mesh data is not representable as protobuf: %v", err)
+		}
+		return proto.Marshal(value)
+	},
+}
+
+// negotiateFormat picks a responseFormat from an Accept header, defaulting
+// to JSON for an empty, missing or unrecognized header.
+func negotiateFormat(accept string) responseFormat {
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+		switch mediaType {
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return yamlResponseFormat
+		case "application/x-protobuf", "application/protobuf":
+			return protobufResponseFormat
+		case "application/json", "*/*", "":
+			return jsonResponseFormat
+		}
+	}
+	return jsonResponseFormat
 }
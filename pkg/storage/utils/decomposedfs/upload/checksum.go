@@ -0,0 +1,104 @@
+// Copyright 2018-2022 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package upload
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"hash/adler32"
+	"net/http"
+	"strings"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// ChecksumHeader is the HTTP header the TUS checksum extension uses to carry
+// the checksum of the chunk being sent with a PATCH (or a creation-with-upload
+// POST). See https://tus.io/protocols/resumable-upload.html#checksum
+const ChecksumHeader = "Upload-Checksum"
+
+type checksumHeaderKeyType struct{}
+
+var checksumHeaderKey = checksumHeaderKeyType{}
+
+// ChecksumMiddleware wraps the tusd handler so the Upload-Checksum header of an incoming
+// request is reachable from Upload.WriteChunk, which tusd itself only ever hands a detached
+// context.Background(). The header is stashed on the *http.Request's context here, upstream of
+// tusd's own routing, so it is already present on the ctx tusd passes into the composer's
+// NewUpload/GetUpload - which is where it must be read from (see upload.Ctx), since WriteChunk
+// never sees this *http.Request or its context at all.
+func ChecksumMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h := r.Header.Get(ChecksumHeader); h != "" {
+			r = r.WithContext(context.WithValue(r.Context(), checksumHeaderKey, h))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checksumFromContext returns the algorithm and decoded sum sent via the
+// Upload-Checksum header, as stashed there by ChecksumMiddleware, along with
+// whether a (parseable) header was present at all.
+func checksumFromContext(ctx context.Context) (alg string, sum []byte, ok bool) {
+	h, _ := ctx.Value(checksumHeaderKey).(string)
+	if h == "" {
+		return "", nil, false
+	}
+	return parseChecksumHeader(h)
+}
+
+// parseChecksumHeader parses the `<algorithm> <base64>` format defined by the
+// TUS checksum extension.
+func parseChecksumHeader(h string) (alg string, sum []byte, ok bool) {
+	algorithm, encoded, found := strings.Cut(h, " ")
+	if !found {
+		return "", nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, false
+	}
+	return strings.ToLower(algorithm), decoded, true
+}
+
+// newChunkHasher returns a hasher for one of the algorithms the TUS checksum
+// extension may request for a single chunk: sha1 and md5 per spec, plus
+// adler32 so it lines up with the checksums we already support for OC-Checksum
+// on upload creation. It returns nil for anything else.
+func newChunkHasher(alg string) hash.Hash {
+	switch alg {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "adler32":
+		return adler32.New()
+	default:
+		return nil
+	}
+}
+
+// errUnsupportedChunkChecksum is returned by WriteChunk when the client's Upload-Checksum
+// header names an algorithm newChunkHasher has no hasher for. The TUS checksum extension
+// requires rejecting a request for an algorithm the server cannot check, rather than
+// accepting the chunk without the validation the client explicitly asked for.
+var errUnsupportedChunkChecksum = tusd.NewError("ERR_INVALID_CHECKSUM_ALGORITHM", "unsupported checksum algorithm", http.StatusBadRequest)
@@ -0,0 +1,38 @@
+// Copyright 2018-2022 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package upload
+
+import (
+	"net/http"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// NewHTTPHandler builds the http.Handler that serves the TUS protocol for decomposedfs
+// uploads. It must be used instead of calling tusd.NewHandler directly, since it wraps the
+// result with ChecksumMiddleware: tusd hands Upload.WriteChunk a bare context.Background(),
+// so without this wrapping the Upload-Checksum header of an incoming PATCH never reaches
+// checksumFromContext and per-chunk checksum validation silently never runs.
+func NewHTTPHandler(cfg tusd.Config) (http.Handler, error) {
+	h, err := tusd.NewHandler(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ChecksumMiddleware(h), nil
+}
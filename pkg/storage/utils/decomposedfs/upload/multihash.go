@@ -0,0 +1,188 @@
+// Copyright 2018-2022 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"hash/adler32"
+	"io"
+
+	"github.com/cs3org/reva/v2/pkg/storage/utils/decomposedfs/metadata/prefixes"
+	"github.com/cs3org/reva/v2/pkg/storage/utils/decomposedfs/node"
+	"lukechampine.com/blake3"
+)
+
+// DefaultUploadChecksums are the algorithms used when the driver was not
+// configured with an explicit list, matching the historic sha1+md5+adler32
+// trio FinishUpload used to hardcode.
+var DefaultUploadChecksums = []string{"sha1", "md5", "adler32"}
+
+// MultiHash tees a single io.Writer into the hash.Hash of every configured
+// algorithm, so an upload only has to be read once to produce all of the
+// checksums a deployment cares about. Inspired by GitLab Workhorse's
+// destination/multi_hash.go.
+type MultiHash struct {
+	hashes map[string]hash.Hash
+	writer io.Writer
+}
+
+// NewMultiHash builds a MultiHash for the given algorithm names (sha1, md5,
+// adler32, sha256, sha512, blake3). Unrecognized names are skipped rather
+// than causing an error, so an operator typo in the config does not take
+// uploads down; callers should log what was configured vs. what was used.
+func NewMultiHash(algorithms []string) *MultiHash {
+	if len(algorithms) == 0 {
+		algorithms = DefaultUploadChecksums
+	}
+
+	mh := &MultiHash{hashes: make(map[string]hash.Hash, len(algorithms))}
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, alg := range algorithms {
+		h := newMultiHasher(alg)
+		if h == nil {
+			continue
+		}
+		mh.hashes[alg] = h
+		writers = append(writers, h)
+	}
+	mh.writer = io.MultiWriter(writers...)
+	return mh
+}
+
+func newMultiHasher(alg string) hash.Hash {
+	switch alg {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "adler32":
+		return adler32.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	case "blake3":
+		return blake3.New(32, nil)
+	default:
+		return nil
+	}
+}
+
+// Write implements io.Writer, feeding p into every configured hasher.
+func (mh *MultiHash) Write(p []byte) (int, error) {
+	return mh.writer.Write(p)
+}
+
+// Has reports whether alg is one of the configured algorithms.
+func (mh *MultiHash) Has(alg string) bool {
+	_, ok := mh.hashes[alg]
+	return ok
+}
+
+// Sum returns the hex digest for alg, or "" if alg was not configured.
+func (mh *MultiHash) Sum(alg string) string {
+	h, ok := mh.hashes[alg]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Attributes returns the node xattrs to persist for every configured
+// algorithm, keyed with prefixes.ChecksumPrefix.
+func (mh *MultiHash) Attributes() node.Attributes {
+	attrs := make(node.Attributes, len(mh.hashes))
+	for alg, h := range mh.hashes {
+		attrs[prefixes.ChecksumPrefix+alg] = h.Sum(nil)
+	}
+	return attrs
+}
+
+// MarshalStates returns the BinaryMarshaler state of every hasher that
+// supports it, ready to be stored in tus.Session.HashStates.
+func (mh *MultiHash) MarshalStates() map[string][]byte {
+	states := make(map[string][]byte, len(mh.hashes))
+	for alg, h := range mh.hashes {
+		marshaler, ok := h.(encoding.BinaryMarshaler)
+		if !ok {
+			continue
+		}
+		state, err := marshaler.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		states[alg] = state
+	}
+	return states
+}
+
+// UnmarshalStates restores hasher state previously produced by MarshalStates, for every
+// algorithm whose state is present, supported (e.g. blake3 does not implement
+// BinaryUnmarshaler) and not corrupt. It returns the algorithms that could NOT be restored;
+// their hashers are left freshly initialized, so the caller must either exclude them from
+// further incremental writes (see Freeze) or fall back to re-reading the blob for them.
+func (mh *MultiHash) UnmarshalStates(states map[string][]byte) (unresumable []string) {
+	for alg, h := range mh.hashes {
+		state, ok := states[alg]
+		if !ok {
+			unresumable = append(unresumable, alg)
+			continue
+		}
+		unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok {
+			unresumable = append(unresumable, alg)
+			continue
+		}
+		if err := unmarshaler.UnmarshalBinary(state); err != nil {
+			unresumable = append(unresumable, alg)
+		}
+	}
+	return unresumable
+}
+
+// Freeze excludes algs from future Write calls. It is used after a partially failed
+// UnmarshalStates, so an algorithm whose state could not be restored does not keep receiving
+// post-resume bytes into a hasher that was reset to zero - which would silently produce a
+// checksum for the wrong byte range instead of the whole upload.
+func (mh *MultiHash) Freeze(algs []string) {
+	if len(algs) == 0 {
+		return
+	}
+
+	frozen := make(map[string]struct{}, len(algs))
+	for _, alg := range algs {
+		frozen[alg] = struct{}{}
+	}
+
+	writers := make([]io.Writer, 0, len(mh.hashes))
+	for alg, h := range mh.hashes {
+		if _, ok := frozen[alg]; ok {
+			delete(mh.hashes, alg)
+			continue
+		}
+		writers = append(writers, h)
+	}
+	mh.writer = io.MultiWriter(writers...)
+}
@@ -19,13 +19,10 @@
 package upload
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
 	"hash"
-	"hash/adler32"
 	"io"
 	"io/fs"
 	"os"
@@ -73,6 +70,11 @@ type Tree interface {
 	PurgeRecycleItemFunc(ctx context.Context, spaceid, key, purgePath string) (*node.Node, func() error, error)
 
 	WriteBlob(node *node.Node, binPath string) error
+	// WriteBlobFromReader uploads size bytes read from r to the blobstore for node. It lets
+	// callers stream straight from an in-memory pipe instead of always handing the tree a path
+	// on local disk, so the read that feeds it can be teed into other work (checksumming,
+	// progress counters, ...) without a second full pass over the data.
+	WriteBlobFromReader(node *node.Node, r io.Reader, size int64) error
 	ReadBlob(node *node.Node) (io.ReadCloser, error)
 	DeleteBlob(node *node.Node) error
 
@@ -102,17 +104,33 @@ type Upload struct {
 	async bool
 	// tknopts hold token signing information
 	tknopts options.TokenOptions
+	// multiHash is the set of running checksum hashers WriteChunk feeds every chunk into, so
+	// FinishUpload can Sum() them instead of re-reading the blob. On a resumed upload it only
+	// holds the algorithms whose state could actually be restored from the session.
+	multiHash *MultiHash
+	// fallbackHash holds the algorithms rehydrateMultiHash could NOT restore state for on a
+	// resumed upload (e.g. blake3, which does not implement BinaryMarshaler). It is nil unless
+	// FinishUpload needs to re-read the blob, and then only for these algorithms rather than
+	// for every configured one.
+	fallbackHash *MultiHash
 }
 
-func buildUpload(ctx context.Context, session tus.Session, lu *lookup.Lookup, tp Tree, pub events.Publisher, async bool, tknopts options.TokenOptions) *Upload {
+func buildUpload(ctx context.Context, session tus.Session, lu *lookup.Lookup, tp Tree, pub events.Publisher, async bool, tknopts options.TokenOptions, opts options.Options) *Upload {
+	checksums := opts.UploadChecksums
+	if len(checksums) == 0 {
+		checksums = DefaultUploadChecksums
+	}
+	multiHash, fallbackHash := rehydrateMultiHash(ctx, session, checksums)
 	return &Upload{
-		Session: session,
-		lu:      lu,
-		tp:      tp,
-		Ctx:     ctx,
-		pub:     pub,
-		async:   async,
-		tknopts: tknopts,
+		Session:      session,
+		lu:           lu,
+		tp:           tp,
+		Ctx:          ctx,
+		pub:          pub,
+		async:        async,
+		tknopts:      tknopts,
+		multiHash:    multiHash,
+		fallbackHash: fallbackHash,
 		log: appctx.GetLogger(ctx).
 			With().
 			Interface("session", session).
@@ -120,6 +138,32 @@ func buildUpload(ctx context.Context, session tus.Session, lu *lookup.Lookup, tp
 	}
 }
 
+// rehydrateMultiHash builds the MultiHash that WriteChunk feeds every chunk into, restoring
+// as much of its state from the session's persisted HashStates as it can. Any algorithm whose
+// state could not be restored (e.g. an upload that predates this feature, or blake3, which does
+// not implement BinaryMarshaler) is excluded from the returned MultiHash and handed back as a
+// fresh MultiHash of its own, so FinishUpload can re-read the blob for just those algorithms
+// instead of falling all the way back to a full re-read for every configured one.
+func rehydrateMultiHash(ctx context.Context, session tus.Session, algorithms []string) (resumable, fallback *MultiHash) {
+	mh := NewMultiHash(algorithms)
+	if session.Offset == 0 {
+		return mh, nil
+	}
+
+	unresumable := mh.UnmarshalStates(session.HashStates)
+	if len(unresumable) == 0 {
+		return mh, nil
+	}
+
+	appctx.GetLogger(ctx).Warn().
+		Str("session", session.ID).
+		Strs("algorithms", unresumable).
+		Msg("could not restore persisted hash state for these checksum algorithms, falling back to a full re-read of the upload for them")
+
+	mh.Freeze(unresumable)
+	return mh, NewMultiHash(unresumable)
+}
+
 // Cleanup cleans the upload
 func Cleanup(upload *Upload, failure bool, keepUpload bool) {
 	ctx, span := tracer.Start(upload.Ctx, "Cleanup")
@@ -136,9 +180,28 @@ func Cleanup(upload *Upload, failure bool, keepUpload bool) {
 
 // WriteChunk writes the stream from the reader to the given offset of the upload
 func (upload *Upload) WriteChunk(_ context.Context, offset int64, src io.Reader) (int64, error) {
-	ctx, span := tracer.Start(upload.Ctx, "WriteChunk")
+	octx, span := tracer.Start(upload.Ctx, "WriteChunk")
 	defer span.End()
-	_, subspan := tracer.Start(ctx, "os.OpenFile")
+
+	// the TUS checksum extension (https://tus.io/protocols/resumable-upload.html#checksum)
+	// lets the client ask us to verify this chunk before it is considered written.
+	// tusd hands this method a detached context.Background() instead of the originating
+	// *http.Request's context (hence the method's own ctx parameter is discarded above, like
+	// every other method on Upload), so ChecksumMiddleware cannot reach WriteChunk through it.
+	// upload.Ctx is the one context field that does carry the real request context: it is set
+	// from the ctx tusd's composer passes into NewUpload/GetUpload, which - by the time tusd
+	// calls either - has already been through ChecksumMiddleware.
+	alg, expected, hasChecksum := checksumFromContext(upload.Ctx)
+	var chunkHash hash.Hash
+	if hasChecksum {
+		if chunkHash = newChunkHasher(alg); chunkHash == nil {
+			// the client explicitly asked for integrity checking on an algorithm we cannot
+			// compute - accepting the chunk unchecked would silently ignore that request
+			return 0, errUnsupportedChunkChecksum
+		}
+	}
+
+	_, subspan := tracer.Start(octx, "os.OpenFile")
 	file, err := os.OpenFile(upload.Session.BinPath, os.O_WRONLY|os.O_APPEND, defaultFilePerm)
 	subspan.End()
 	if err != nil {
@@ -146,12 +209,15 @@ func (upload *Upload) WriteChunk(_ context.Context, offset int64, src io.Reader)
 	}
 	defer file.Close()
 
-	// calculate cheksum here? needed for the TUS checksum extension. https://tus.io/protocols/resumable-upload.html#checksum
-	// TODO but how do we get the `Upload-Checksum`? WriteChunk() only has a context, offset and the reader ...
-	// It is sent with the PATCH request, well or in the POST when the creation-with-upload extension is used
-	// but the tus handler uses a context.Background() so we cannot really check the header and put it in the context ...
-	_, subspan = tracer.Start(ctx, "io.Copy")
-	n, err := io.Copy(file, src)
+	writers := []io.Writer{file}
+	if chunkHash != nil {
+		writers = append(writers, chunkHash)
+	}
+	writers = append(writers, upload.multiHash)
+	w := io.MultiWriter(writers...)
+
+	_, subspan = tracer.Start(octx, "io.Copy")
+	n, err := io.Copy(w, src)
 	subspan.End()
 
 	// If the HTTP PATCH request gets interrupted in the middle (e.g. because
@@ -162,10 +228,28 @@ func (upload *Upload) WriteChunk(_ context.Context, offset int64, src io.Reader)
 		return n, err
 	}
 
+	if chunkHash != nil && !bytes.Equal(chunkHash.Sum(nil), expected) {
+		// leave the offset where it was before this chunk so the client can retry it
+		if terr := file.Truncate(offset); terr != nil {
+			upload.log.Error().Err(terr).Str("path", upload.Session.BinPath).Msg("truncating chunk after checksum mismatch failed")
+		}
+		return 0, tusd.ErrChecksumMismatch
+	}
+
 	// update upload.Session.Offset so subsequent code flow can use it.
 	// No need to persist the session as the offset is determined by stating the blob in the GetUpload codepath.
 	// The session offset is written to disk in FinishUpload
 	upload.Session.Offset += n
+
+	// persist the running hash state alongside the offset so a resumed upload can rehydrate
+	// it instead of re-reading the blob. Algorithms in fallbackHash are deliberately excluded
+	// here: rehydrateMultiHash already could not resume them for this session, so there is
+	// nothing to gain from persisting their (always from-scratch) state again.
+	upload.Session.HashStates = upload.multiHash.MarshalStates()
+	if err := upload.Session.Persist(upload.Ctx); err != nil {
+		upload.log.Error().Err(err).Str("session", upload.Session.ID).Msg("persisting hash state failed")
+	}
+
 	return n, nil
 }
 
@@ -192,58 +276,43 @@ func (upload *Upload) FinishUpload(_ context.Context) error {
 
 	log := appctx.GetLogger(upload.Ctx)
 
-	// calculate the checksum of the written bytes
+	// calculate the checksums of the written bytes
 	// they will all be written to the metadata later, so we cannot omit any of them
 	// TODO only calculate the checksum in sync that was requested to match, the rest could be async ... but the tests currently expect all to be present
-	// TODO the hashes all implement BinaryMarshaler so we could try to persist the state for resumable upload. we would neet do keep track of the copied bytes ...
-	sha1h := sha1.New()
-	md5h := md5.New()
-	adler32h := adler32.New()
-	{
+	if upload.fallbackHash != nil {
+		// some configured algorithm(s) could not resume from persisted hash state (see
+		// rehydrateMultiHash); re-read the blob once just for those, instead of falling all
+		// the way back to a full re-read for every configured algorithm. This read happens
+		// before the node exists, so it cannot be folded into the blobstore write below -
+		// WriteBlobFromReader needs a node, and CreateNodeForUpload needs these checksums
+		// first.
 		_, subspan := tracer.Start(ctx, "os.Open")
 		f, err := os.Open(upload.Session.BinPath)
 		subspan.End()
 		if err != nil {
-			// we can continue if no oc checksum header is set
+			// we can continue if no checksum header is set
 			log.Info().Err(err).Str("binPath", upload.Session.BinPath).Msg("error opening binPath")
 		}
 		defer f.Close()
 
-		r1 := io.TeeReader(f, sha1h)
-		r2 := io.TeeReader(r1, md5h)
-
 		_, subspan = tracer.Start(ctx, "io.Copy")
-		_, err = io.Copy(adler32h, r2)
+		_, err = io.Copy(upload.fallbackHash, f)
 		subspan.End()
 		if err != nil {
 			log.Info().Err(err).Msg("error copying checksums")
 		}
 	}
 
-	// compare if they match the sent checksum
-	// TODO the tus checksum extension would do this on every chunk, but I currently don't see an easy way to pass in the requested checksum. for now we do it in FinishUpload which is also called for chunked uploads
-	var err error
-	switch {
-	case upload.Session.ChecksumSHA1 != "":
-		err = upload.checkHash(upload.Session.ChecksumSHA1, sha1h)
-	case upload.Session.ChecksumMD5 != "":
-		err = upload.checkHash(upload.Session.ChecksumMD5, md5h)
-	case upload.Session.ChecksumADLER32 != "":
-		err = upload.checkHash(upload.Session.ChecksumADLER32, adler32h)
-	}
-	if err != nil {
+	// compare if it matches the sent checksum
+	// the TUS checksum extension already validated every chunk as it came in via WriteChunk;
+	// this is the fallback for the OC-Checksum header sent on upload creation, which only ever
+	// covers the whole file
+	if err := upload.checkHash(); err != nil {
 		Cleanup(upload, true, false)
 		return err
 	}
 
-	// update checksums
-	attrs := node.Attributes{
-		prefixes.ChecksumPrefix + "sha1":    sha1h.Sum(nil),
-		prefixes.ChecksumPrefix + "md5":     md5h.Sum(nil),
-		prefixes.ChecksumPrefix + "adler32": adler32h.Sum(nil),
-	}
-
-	n, err := CreateNodeForUpload(upload, attrs)
+	n, err := CreateNodeForUpload(upload, upload.attributes())
 	if err != nil {
 		Cleanup(upload, true, false)
 		return err
@@ -322,7 +391,15 @@ func (upload *Upload) ConcatUploads(_ context.Context, uploads []tusd.Upload) (e
 	return
 }
 
-// Finalize finalizes the upload (eg moves the file to the internal destination)
+// Finalize finalizes the upload (eg moves the file to the internal destination).
+//
+// Finalize reads the upload's binary from local disk once more and streams it to the blobstore
+// through pipeToBlobstore, which overlaps that read with the remote write. It computes no
+// checksums: CreateNodeForUpload has already needed them to create the node before Finalize
+// runs, so hashing and the blobstore write are separate passes over the data. For an upload
+// that goes through FinishUpload's fallbackHash branch, the blob is therefore read from disk
+// twice after its last chunk arrived: once there to hash the unresumable algorithms, and once
+// here for the blobstore write.
 func (upload *Upload) Finalize() (err error) {
 	ctx, span := tracer.Start(upload.Ctx, "Finalize")
 	defer span.End()
@@ -336,9 +413,17 @@ func (upload *Upload) Finalize() (err error) {
 		upload.Node = n
 	}
 
-	// upload the data to the blobstore
+	// upload the data to the blobstore. By the time Finalize runs, the checksums have already
+	// been established - either incrementally by WriteChunk, or by the re-read in FinishUpload -
+	// so this pass only has to stream the bytes through, not hash them again.
+	f, err := os.Open(upload.Session.BinPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open upload binary for blobstore write")
+	}
+	defer f.Close()
+
 	_, subspan := tracer.Start(ctx, "WriteBlob")
-	err = upload.tp.WriteBlob(n, upload.Session.BinPath)
+	_, err = upload.pipeToBlobstore(n, f)
 	subspan.End()
 	if err != nil {
 		return errors.Wrap(err, "failed to upload file to blobstore")
@@ -347,10 +432,81 @@ func (upload *Upload) Finalize() (err error) {
 	return nil
 }
 
-func (upload *Upload) checkHash(expected string, h hash.Hash) error {
-	hash := hex.EncodeToString(h.Sum(nil))
-	if expected != hash {
-		return errtypes.ChecksumMismatch(fmt.Sprintf("invalid checksum: expected %s got %x", expected, hash))
+// pipeToBlobstore reads from src exactly once and concurrently streams it to the blobstore for
+// n via an io.Pipe, so the (potentially slow) remote write overlaps the local read instead of
+// following it as a separate full pass. It returns the number of bytes read from src.
+//
+// By the time Finalize calls this, every checksum has already been established - either
+// incrementally by WriteChunk, or by FinishUpload's re-read for whatever couldn't be resumed -
+// so there is nothing left to tee into here; this is purely a read/write overlap, not a hash
+// pass.
+func (upload *Upload) pipeToBlobstore(n *node.Node, src io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var size int64
+	var copyErr error
+
+	go func() {
+		defer close(done)
+		size, copyErr = io.Copy(pw, src)
+		pw.CloseWithError(copyErr)
+	}()
+
+	writeErr := upload.tp.WriteBlobFromReader(n, pr, upload.Session.Size)
+	// in case WriteBlobFromReader returned early (e.g. on a remote write error) without
+	// draining the pipe, close the read side so the goroutine's blocked Write unblocks too
+	pr.Close()
+	<-done
+
+	if writeErr != nil {
+		return size, writeErr
+	}
+	return size, copyErr
+}
+
+// digest returns the hex digest of alg across both upload.multiHash and, if present,
+// upload.fallbackHash, and whether alg was configured at all.
+func (upload *Upload) digest(alg string) (digest string, known bool) {
+	if upload.multiHash.Has(alg) {
+		return upload.multiHash.Sum(alg), true
+	}
+	if upload.fallbackHash != nil && upload.fallbackHash.Has(alg) {
+		return upload.fallbackHash.Sum(alg), true
+	}
+	return "", false
+}
+
+// attributes merges the node xattrs of upload.multiHash with those of upload.fallbackHash, if
+// any, into the full set of checksums to persist for the upload.
+func (upload *Upload) attributes() node.Attributes {
+	attrs := upload.multiHash.Attributes()
+	if upload.fallbackHash != nil {
+		for k, v := range upload.fallbackHash.Attributes() {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// checkHash validates upload's checksums against the checksum requested on upload creation,
+// if any. upload.Session.Checksum is expected in "<algorithm> <hex>" format.
+func (upload *Upload) checkHash() error {
+	if upload.Session.Checksum == "" {
+		return nil
+	}
+
+	alg, expected, ok := strings.Cut(upload.Session.Checksum, " ")
+	if !ok {
+		return errtypes.BadRequest(fmt.Sprintf("invalid checksum format %q, expected '<algorithm> <hash>'", upload.Session.Checksum))
+	}
+
+	got, known := upload.digest(alg)
+	if !known {
+		return errtypes.BadRequest(fmt.Sprintf("unsupported checksum algorithm %q", alg))
+	}
+
+	if expected != got {
+		return errtypes.ChecksumMismatch(fmt.Sprintf("invalid checksum: expected %s got %s", expected, got))
 	}
 	return nil
 }
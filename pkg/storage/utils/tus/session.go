@@ -0,0 +1,103 @@
+// Copyright 2018-2022 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+// Package tus holds the on-disk representation of a TUS upload as used by the
+// decomposedfs storage driver.
+package tus
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// Session represents the metadata of an in-progress or finished TUS upload.
+// It is persisted next to the upload's binary so the upload can be resumed
+// (or inspected) across requests and process restarts.
+type Session struct {
+	ID       string
+	BinPath  string
+	InfoPath string
+
+	Filename       string
+	Size           int64
+	SizeIsDeferred bool
+	SizeDiff       int64
+	Offset         int64
+
+	SpaceRoot    string
+	NodeID       string
+	VersionsPath string
+	LockID       string
+
+	// Checksum is the checksum requested on upload creation, in the
+	// "<algorithm> <hex>" format, e.g. "sha256 <hex>". Algorithm names match
+	// those accepted by MultiHash.
+	Checksum string
+
+	// HashStates holds the marshaled state (see encoding.BinaryMarshaler) of
+	// the running hashers WriteChunk feeds every chunk into, keyed by
+	// algorithm name (e.g. "sha1", "md5", "adler32"). It lets a resumed
+	// upload rehydrate its hashers instead of re-reading the whole blob in
+	// FinishUpload.
+	HashStates map[string][]byte
+
+	MetaData map[string]string
+}
+
+// ToFileInfo converts the session into the tusd.FileInfo the tus handler expects.
+func (s Session) ToFileInfo() tusd.FileInfo {
+	return tusd.FileInfo{
+		ID:             s.ID,
+		Size:           s.Size,
+		SizeIsDeferred: s.SizeIsDeferred,
+		Offset:         s.Offset,
+		MetaData:       s.MetaData,
+		Storage: map[string]string{
+			"Type": "decomposedfs",
+			"Path": s.BinPath,
+		},
+	}
+}
+
+// Persist writes the session to disk as JSON next to the upload's binary.
+func (s Session) Persist(_ context.Context) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.InfoPath, data, 0600)
+}
+
+// Purge removes the persisted session info from disk.
+func (s Session) Purge(_ context.Context) error {
+	return os.Remove(s.InfoPath)
+}
+
+// ReadSession reads a persisted session from infoPath.
+func ReadSession(_ context.Context, infoPath string) (Session, error) {
+	var s Session
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}